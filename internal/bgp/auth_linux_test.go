@@ -0,0 +1,62 @@
+//go:build linux
+
+package bgp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// These tests only catch gross layout mistakes (wrong field sizes,
+// accidental padding) in tcpMD5Sig/tcpAOAdd; they can't confirm the
+// layout matches the kernel's ABI without a real kernel to test against.
+// See the warning on tcpAOAdd.
+
+func TestTCPMD5SigSize(t *testing.T) {
+	var sig tcpMD5Sig
+	if got, want := unsafe.Sizeof(sig), uintptr(128+1+1+2+4+maxMD5KeyLen); got != want {
+		t.Errorf("unsafe.Sizeof(tcpMD5Sig{}) = %d, want %d", got, want)
+	}
+}
+
+func TestTCPAOAddSize(t *testing.T) {
+	var add tcpAOAdd
+	if got, want := unsafe.Sizeof(add), uintptr(128+64+4+4+2+1+1+1+1+1+1+maxAOKeyLen); got != want {
+		t.Errorf("unsafe.Sizeof(tcpAOAdd{}) = %d, want %d", got, want)
+	}
+}
+
+func TestSetTCPAOKeyRefusedUntilVerified(t *testing.T) {
+	if tcpAOLayoutVerified {
+		t.Fatal("tcpAOLayoutVerified is true, but the tcpAOAdd layout still carries the unverified warning above - update this test once it's actually verified")
+	}
+	if err := setTCPAOKey(-1, net.ParseIP("10.0.0.1"), "secret"); err == nil {
+		t.Error("setTCPAOKey succeeded with tcpAOLayoutVerified false, want an error")
+	}
+}
+
+func TestFillSockaddrV4(t *testing.T) {
+	buf := make([]byte, 128)
+	fillSockaddr(buf, net.ParseIP("10.0.0.1"))
+
+	if got := (*uint16)(unsafe.Pointer(&buf[0])); *got != syscall.AF_INET {
+		t.Errorf("got family %d, want AF_INET (%d)", *got, syscall.AF_INET)
+	}
+	if got := net.IP(buf[4:8]); !got.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got address %v, want 10.0.0.1", got)
+	}
+}
+
+func TestFillSockaddrV6(t *testing.T) {
+	buf := make([]byte, 128)
+	fillSockaddr(buf, net.ParseIP("2001:db8::1"))
+
+	if got := (*uint16)(unsafe.Pointer(&buf[0])); *got != syscall.AF_INET6 {
+		t.Errorf("got family %d, want AF_INET6 (%d)", *got, syscall.AF_INET6)
+	}
+	if got := net.IP(buf[8:24]); !got.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got address %v, want 2001:db8::1", got)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+)
+
+// dialWithAuth is only implemented on Linux, where TCP_MD5SIG and
+// TCP_AO_ADD_KEY are available as socket options.
+func dialWithAuth(addr string, password string, algo AuthAlgorithm) (net.Conn, error) {
+	return nil, fmt.Errorf("TCP-MD5/TCP-AO authentication is not supported on this platform")
+}
@@ -0,0 +1,324 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// bfdPort is the well-known UDP port for single-hop BFD control packets,
+// RFC 5880 section 2.
+const bfdPort = 3784
+
+// BFD session states, RFC 5880 section 6.8.1.
+type bfdState uint8
+
+const (
+	bfdAdminDown bfdState = 0
+	bfdDown      bfdState = 1
+	bfdInit      bfdState = 2
+	bfdUp        bfdState = 3
+)
+
+func (s bfdState) String() string {
+	switch s {
+	case bfdAdminDown:
+		return "AdminDown"
+	case bfdDown:
+		return "Down"
+	case bfdInit:
+		return "Init"
+	case bfdUp:
+		return "Up"
+	default:
+		return "Unknown"
+	}
+}
+
+// BFDConfig enables BFD (Bidirectional Forwarding Detection, RFC 5880)
+// for a peer, so that MetalLB can detect its failure in well under a
+// second instead of waiting for the BGP holdtime to expire.
+type BFDConfig struct {
+	// MinTx is the minimum interval at which we send control packets.
+	MinTx time.Duration
+	// MinRx is the minimum interval at which we're willing to receive
+	// control packets.
+	MinRx time.Duration
+	// DetectMult is the number of missed control packets that declares
+	// the peer Down.
+	DetectMult uint8
+}
+
+type bfdPacket struct {
+	version, diag     uint8
+	state             bfdState
+	poll, final       bool
+	detectMult        uint8
+	myDiscriminator   uint32
+	yourDiscriminator uint32
+	desiredMinTx      time.Duration
+	requiredMinRx     time.Duration
+	requiredMinEchoRx time.Duration
+}
+
+func marshalBFD(p *bfdPacket) []byte {
+	buf := make([]byte, 24)
+	buf[0] = (p.version << 5) | (p.diag & 0x1f)
+
+	flags := uint8(p.state) << 6
+	if p.poll {
+		flags |= 1 << 5
+	}
+	if p.final {
+		flags |= 1 << 4
+	}
+	buf[1] = flags
+
+	buf[2] = p.detectMult
+	buf[3] = 24
+	binary.BigEndian.PutUint32(buf[4:8], p.myDiscriminator)
+	binary.BigEndian.PutUint32(buf[8:12], p.yourDiscriminator)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(p.desiredMinTx/time.Microsecond))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(p.requiredMinRx/time.Microsecond))
+	binary.BigEndian.PutUint32(buf[20:24], uint32(p.requiredMinEchoRx/time.Microsecond))
+	return buf
+}
+
+func unmarshalBFD(buf []byte) (*bfdPacket, error) {
+	if len(buf) < 24 {
+		return nil, errBFDShortPacket
+	}
+	return &bfdPacket{
+		version:           buf[0] >> 5,
+		diag:              buf[0] & 0x1f,
+		state:             bfdState(buf[1] >> 6),
+		poll:              buf[1]&(1<<5) != 0,
+		final:             buf[1]&(1<<4) != 0,
+		detectMult:        buf[2],
+		myDiscriminator:   binary.BigEndian.Uint32(buf[4:8]),
+		yourDiscriminator: binary.BigEndian.Uint32(buf[8:12]),
+		desiredMinTx:      time.Duration(binary.BigEndian.Uint32(buf[12:16])) * time.Microsecond,
+		requiredMinRx:     time.Duration(binary.BigEndian.Uint32(buf[16:20])) * time.Microsecond,
+		requiredMinEchoRx: time.Duration(binary.BigEndian.Uint32(buf[20:24])) * time.Microsecond,
+	}, nil
+}
+
+var errBFDShortPacket = &bfdError{"BFD control packet shorter than 24 bytes"}
+
+type bfdError struct{ s string }
+
+func (e *bfdError) Error() string { return e.s }
+
+// bfdSession runs the BFD state machine for one BGP peer, tearing down the
+// BGP session via onDown as soon as the peer is declared Down.
+type bfdSession struct {
+	cfg    *BFDConfig
+	peer   string
+	onDown func()
+
+	localDiscriminator uint32
+
+	mu                  sync.Mutex
+	state               bfdState
+	remoteDiscriminator uint32
+	// remoteMinTx and remoteDetectMult are the peer's Desired Min TX
+	// Interval and Detect Mult, as received in its last control packet.
+	// Both feed detectionTime, per RFC 5880 section 6.8.4.
+	remoteMinTx      time.Duration
+	remoteDetectMult uint8
+	lastRecv         time.Time
+
+	conn    *net.UDPConn
+	stopped chan struct{}
+}
+
+// registry demultiplexes incoming BFD control packets to the right
+// session, since all peers share the well-known destination port 3784.
+var (
+	bfdRegistryMu sync.Mutex
+	bfdRegistry   = map[uint32]*bfdSession{}
+	bfdListenOnce sync.Once
+)
+
+func newBFDSession(peerIP string, cfg *BFDConfig, onDown func()) *bfdSession {
+	s := &bfdSession{
+		cfg:                cfg,
+		peer:               peerIP,
+		onDown:             onDown,
+		localDiscriminator: rand.Uint32(),
+		state:              bfdAdminDown,
+		stopped:            make(chan struct{}),
+	}
+	bfdRegistryMu.Lock()
+	bfdRegistry[s.localDiscriminator] = s
+	bfdRegistryMu.Unlock()
+	return s
+}
+
+// run dials the peer and drives the BFD state machine until stop is
+// called. One goroutine per peer runs this loop.
+func (s *bfdSession) run() {
+	bfdListenOnce.Do(startBFDListener)
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(s.peer), Port: bfdPort})
+	if err != nil {
+		glog.Errorf("BFD: dialing peer %q: %s", s.peer, err)
+		return
+	}
+	s.conn = conn
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.state = bfdDown
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.cfg.MinTx)
+	defer ticker.Stop()
+
+	detectTimer := time.NewTimer(s.detectionTime())
+	defer detectTimer.Stop()
+
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+			s.sendControlPacket()
+		case <-detectTimer.C:
+			s.declareDown()
+			detectTimer.Reset(s.detectionTime())
+		}
+	}
+}
+
+func (s *bfdSession) stop() {
+	bfdRegistryMu.Lock()
+	delete(bfdRegistry, s.localDiscriminator)
+	bfdRegistryMu.Unlock()
+	close(s.stopped)
+}
+
+// detectionTime computes how long we wait for a control packet before
+// declaring the peer Down, per RFC 5880 section 6.8.4: the remote's
+// Detect Mult, times the greater of our own required RX interval and the
+// remote's desired TX interval. Before we've heard from the peer at all,
+// we fall back to our own config.
+func (s *bfdSession) detectionTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interval := s.cfg.MinRx
+	if s.remoteMinTx > interval {
+		interval = s.remoteMinTx
+	}
+
+	mult := s.remoteDetectMult
+	if mult == 0 {
+		mult = s.cfg.DetectMult
+	}
+
+	return interval * time.Duration(mult)
+}
+
+func (s *bfdSession) sendControlPacket() {
+	s.mu.Lock()
+	pkt := &bfdPacket{
+		version:           1,
+		state:             s.state,
+		detectMult:        s.cfg.DetectMult,
+		myDiscriminator:   s.localDiscriminator,
+		yourDiscriminator: s.remoteDiscriminator,
+		desiredMinTx:      s.cfg.MinTx,
+		requiredMinRx:     s.cfg.MinRx,
+	}
+	s.mu.Unlock()
+
+	if _, err := s.conn.Write(marshalBFD(pkt)); err != nil {
+		glog.Errorf("BFD: sending control packet to %q: %s", s.peer, err)
+	}
+}
+
+// handlePacket advances the state machine per RFC 5880 section 6.8.6 in
+// response to a received control packet.
+func (s *bfdSession) handlePacket(pkt *bfdPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remoteDiscriminator = pkt.myDiscriminator
+	s.remoteMinTx = pkt.desiredMinTx
+	s.remoteDetectMult = pkt.detectMult
+	s.lastRecv = time.Now()
+
+	wasUp := s.state == bfdUp
+
+	// State transitions per the table in RFC 5880 section 6.8.6.
+	switch pkt.state {
+	case bfdDown:
+		switch s.state {
+		case bfdDown:
+			s.state = bfdInit
+		case bfdUp:
+			s.state = bfdDown
+		}
+	case bfdInit:
+		if s.state == bfdDown || s.state == bfdInit {
+			s.state = bfdUp
+		}
+	case bfdUp:
+		if s.state != bfdUp {
+			s.state = bfdUp
+		}
+	}
+
+	if wasUp && s.state != bfdUp {
+		glog.Warningf("BFD session to %q went %s", s.peer, s.state)
+		go s.onDown()
+	}
+}
+
+// declareDown fires when no control packet arrives before the detection
+// timer expires, the core of BFD's fast-failure-detection value over
+// plain BGP holdtimes.
+func (s *bfdSession) declareDown() {
+	s.mu.Lock()
+	wasUp := s.state == bfdUp
+	s.state = bfdDown
+	s.mu.Unlock()
+
+	if wasUp {
+		glog.Warningf("BFD session to %q timed out, declaring Down", s.peer)
+		go s.onDown()
+	}
+}
+
+func startBFDListener() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: bfdPort})
+	if err != nil {
+		glog.Errorf("BFD: listening on UDP/%d: %s", bfdPort, err)
+		return
+	}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				glog.Errorf("BFD: reading control packet: %s", err)
+				return
+			}
+			pkt, err := unmarshalBFD(buf[:n])
+			if err != nil {
+				continue
+			}
+			bfdRegistryMu.Lock()
+			sess := bfdRegistry[pkt.yourDiscriminator]
+			bfdRegistryMu.Unlock()
+			if sess != nil {
+				sess.handlePacket(pkt)
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package bgp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshalUnmarshalBFDRoundTrip(t *testing.T) {
+	pkt := &bfdPacket{
+		version:           1,
+		diag:              3,
+		state:             bfdUp,
+		poll:              true,
+		final:             true,
+		detectMult:        5,
+		myDiscriminator:   0xdeadbeef,
+		yourDiscriminator: 0x12345678,
+		desiredMinTx:      100 * time.Millisecond,
+		requiredMinRx:     200 * time.Millisecond,
+		requiredMinEchoRx: 0,
+	}
+
+	got, err := unmarshalBFD(marshalBFD(pkt))
+	if err != nil {
+		t.Fatalf("unmarshalBFD: %s", err)
+	}
+	if !reflect.DeepEqual(got, pkt) {
+		t.Errorf("got %+v, want %+v", got, pkt)
+	}
+}
+
+func TestUnmarshalBFDShortPacket(t *testing.T) {
+	if _, err := unmarshalBFD(make([]byte, 23)); err == nil {
+		t.Error("unmarshalBFD on a 23-byte packet succeeded, want an error")
+	}
+}
+
+func TestDetectionTimeUsesRemoteAnnouncedValues(t *testing.T) {
+	s := &bfdSession{
+		cfg: &BFDConfig{MinRx: 50 * time.Millisecond, DetectMult: 3},
+	}
+
+	// Before anything is heard from the peer, fall back to our own config.
+	if got, want := s.detectionTime(), 150*time.Millisecond; got != want {
+		t.Errorf("detectionTime before first packet = %s, want %s", got, want)
+	}
+
+	// Peer announces a longer TX interval and a different detect mult;
+	// both should be reflected, per RFC 5880 section 6.8.4.
+	s.remoteMinTx = 200 * time.Millisecond
+	s.remoteDetectMult = 7
+	if got, want := s.detectionTime(), 1400*time.Millisecond; got != want {
+		t.Errorf("detectionTime with asymmetric config = %s, want %s", got, want)
+	}
+}
+
+// TestHandlePacketInitInitReachesUp is a regression test: a session that
+// reaches Init locally (having seen the peer at Down) must also reach Up
+// once the peer moves to Init, per the RFC 5880 section 6.8.6 state
+// table. It used to get stuck in Init forever, since the Init case only
+// checked for a local state of Down.
+func TestHandlePacketInitInitReachesUp(t *testing.T) {
+	s := &bfdSession{state: bfdDown, onDown: func() {}}
+
+	s.handlePacket(&bfdPacket{state: bfdDown})
+	if s.state != bfdInit {
+		t.Fatalf("after peer Down, local state = %s, want Init", s.state)
+	}
+
+	s.handlePacket(&bfdPacket{state: bfdInit})
+	if s.state != bfdUp {
+		t.Fatalf("after peer Init while local was Init, local state = %s, want Up", s.state)
+	}
+}
+
+func TestHandlePacketUpToDownOnRemoteDown(t *testing.T) {
+	s := &bfdSession{state: bfdUp, onDown: func() {}}
+
+	s.handlePacket(&bfdPacket{state: bfdDown})
+	if s.state != bfdDown {
+		t.Errorf("after peer Down while local was Up, local state = %s, want Down", s.state)
+	}
+}
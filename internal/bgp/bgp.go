@@ -17,16 +17,45 @@ import (
 
 const (
 	backoff = 2 * time.Second
+
+	// writeQueueDepth bounds how many encoded BGP messages can be queued
+	// for a peer's writer goroutine before further sends are dropped
+	// rather than blocking the caller. At this depth a peer that isn't
+	// draining its socket falls behind by more than a full resync's
+	// worth of updates before anything is lost.
+	writeQueueDepth = 64
 )
 
 var errClosed = errors.New("session closed")
 
+// AuthAlgorithm selects the TCP authentication scheme used to sign a
+// Session's connection, so MetalLB can peer with routers that mandate
+// RFC 2385 TCP-MD5 or RFC 5925 TCP-AO signatures.
+type AuthAlgorithm int
+
+const (
+	// AuthNone means the TCP connection is unauthenticated.
+	AuthNone AuthAlgorithm = iota
+	// AuthMD5 signs segments with TCP_MD5SIG (RFC 2385).
+	AuthMD5
+	// AuthTCPAO signs segments with TCP-AO (RFC 5925), which requires a
+	// kernel >= 6.1. Currently refused at dial time pending verification
+	// of the raw struct layout used to configure it; see
+	// tcpAOLayoutVerified in auth_linux.go.
+	AuthTCPAO
+)
+
 type Session struct {
 	asn      uint32
 	routerID net.IP
 	addr     string
 	peerASN  uint32
 	holdTime time.Duration
+	// password and authAlgorithm configure TCP-MD5 (RFC 2385) or TCP-AO
+	// (RFC 5925) authentication of the session's TCP connection. An
+	// empty password means no authentication.
+	password      string
+	authAlgorithm AuthAlgorithm
 
 	newHoldTime chan bool
 
@@ -35,9 +64,77 @@ type Session struct {
 	closed         bool
 	conn           net.Conn
 	actualHoldTime time.Duration
-	advertised     map[string]*Advertisement
-	new            map[string]*Advertisement
-	pending        *list.List
+	// peerFamilies is the set of AFI/SAFI pairs the peer advertised
+	// support for in its OPEN message. IPv4 unicast is always present,
+	// even for peers that never heard of RFC 4760.
+	peerFamilies map[afiSafi]bool
+	advertised   map[string]*Advertisement
+	new          map[string]*Advertisement
+	pending      *list.List
+
+	// writeCh is how sendUpdates and sendKeepalive hand encoded messages
+	// to writeLoop, which owns the actual socket writes. It's non-nil
+	// exactly when conn is.
+	writeCh chan []byte
+
+	// bfd is non-nil when the peer was configured for BFD fast failover.
+	bfd *bfdSession
+
+	// observers are notified of session lifecycle and update events, in
+	// addition to the Prometheus metrics that are always recorded. See
+	// AddObserver.
+	observers []Observer
+}
+
+// Observer receives a Session's lifecycle and route events. It lets
+// MetalLB mirror BGP activity to an external sink - a BMP station (see
+// the bmp subpackage), a structured log, or a test harness - without the
+// Session itself knowing anything about the sink.
+type Observer interface {
+	// OnPeerUp fires once the session reaches the Established state.
+	OnPeerUp(peer string, peerASN, localASN uint32, routerID net.IP)
+	// OnPeerDown fires when an established session goes down, for any
+	// reason (holdtime expiry, BFD, a write error, or a graceful Close).
+	OnPeerDown(peer string)
+	// OnUpdate fires after adv has been sent to peer. asn is the AS the
+	// UPDATE's AS_PATH was actually encoded with - 0 for an iBGP session,
+	// our own ASN for eBGP - matching MarshalUpdate's asn argument, not
+	// necessarily the peer's ASN.
+	OnUpdate(peer string, asn uint32, adv *Advertisement)
+	// OnWithdraw fires after prefix has been withdrawn from peer.
+	OnWithdraw(peer string, asn uint32, prefix *net.IPNet)
+}
+
+// AddObserver registers o to receive this session's future lifecycle and
+// update events.
+func (s *Session) AddObserver(o Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, o)
+}
+
+func (s *Session) notifyPeerUp() {
+	for _, o := range s.observers {
+		o.OnPeerUp(s.addr, s.peerASN, s.asn, s.routerID)
+	}
+}
+
+func (s *Session) notifyPeerDown() {
+	for _, o := range s.observers {
+		o.OnPeerDown(s.addr)
+	}
+}
+
+func (s *Session) notifyUpdate(asn uint32, adv *Advertisement) {
+	for _, o := range s.observers {
+		o.OnUpdate(s.addr, asn, adv)
+	}
+}
+
+func (s *Session) notifyWithdraw(asn uint32, prefix *net.IPNet) {
+	for _, o := range s.observers {
+		o.OnWithdraw(s.addr, asn, prefix)
+	}
 }
 
 func (s *Session) run() {
@@ -49,6 +146,7 @@ func (s *Session) run() {
 			continue
 		}
 		stats.SessionUp(s.addr)
+		s.notifyPeerUp()
 
 		glog.Infof("BGP session to %q established", s.addr)
 
@@ -59,78 +157,190 @@ func (s *Session) run() {
 			glog.Error(err)
 		}
 		stats.SessionDown(s.addr)
+		s.notifyPeerDown()
 		glog.Infof("BGP session to %q down", s.addr)
 	}
 }
 
+// diffAdvertisements compares the set of advertisements currently sent to
+// a peer against the set that should be sent, and returns the updates
+// that need to be (re-)sent and the prefixes that need to be withdrawn to
+// bring the peer from old to new. It's a pure function, factored out of
+// sendUpdates, so the resync logic can be unit tested without a live
+// socket.
+func diffAdvertisements(old, new map[string]*Advertisement) (updates []*Advertisement, withdraws []*net.IPNet) {
+	for c, adv := range new {
+		if prev, ok := old[c]; ok && prev.NextHop.Equal(adv.NextHop) && reflect.DeepEqual(prev.Communities, adv.Communities) {
+			// Peer already has correct state for this advertisement,
+			// nothing to do.
+			continue
+		}
+		updates = append(updates, adv)
+	}
+
+	for c, adv := range old {
+		if new[c] == nil {
+			withdraws = append(withdraws, adv.Prefix)
+		}
+	}
+
+	return updates, withdraws
+}
+
 func (s *Session) sendUpdates() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	asn := s.asn
 	if s.peerASN == s.asn {
 		asn = 0
 	}
-
 	if s.new != nil {
 		s.advertised, s.new = s.new, nil
 	}
+	advertised := s.advertised
+	peerFamilies := s.peerFamilies
+	s.mu.Unlock()
 
-	for c, adv := range s.advertised {
-		if err := sendUpdate(s.conn, asn, adv); err != nil {
-			s.abort()
-			return fmt.Errorf("sending update of %q to %q: %s", c, s.addr, err)
-		}
-		stats.UpdateSent(s.addr)
+	for _, adv := range advertised {
+		s.enqueueUpdate(asn, adv, peerFamilies)
 	}
-	stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+	stats.AdvertisedPrefixes(s.addr, len(advertised))
 
 	for {
+		s.mu.Lock()
 		for s.new == nil && s.conn != nil {
 			s.cond.Wait()
 		}
 
 		if s.closed {
+			s.mu.Unlock()
 			return errClosed
 		}
 		if s.conn == nil {
+			s.mu.Unlock()
 			return nil
 		}
 		if s.new == nil {
 			// nil is "no pending updates", contrast to a non-nil
 			// empty map which means "withdraw all".
+			s.mu.Unlock()
 			continue
 		}
 
-		for c, adv := range s.new {
-			if adv2, ok := s.advertised[c]; ok && adv2.NextHop.Equal(adv.NextHop) && reflect.DeepEqual(adv2.Communities, adv.Communities) {
-				// Peer already has correct state for this
-				// advertisement, nothing to do.
-				continue
-			}
+		asn = s.asn
+		if s.peerASN == s.asn {
+			asn = 0
+		}
+		oldAdvs := s.advertised
+		newAdvs := s.new
+		peerFamilies = s.peerFamilies
+		s.advertised, s.new = s.new, nil
+		s.mu.Unlock()
 
-			if err := sendUpdate(s.conn, asn, adv); err != nil {
-				s.abort()
-				return fmt.Errorf("sending update of %q to %q: %s", c, s.addr, err)
-			}
-			stats.UpdateSent(s.addr)
+		updates, withdraws := diffAdvertisements(oldAdvs, newAdvs)
+		for _, adv := range updates {
+			s.enqueueUpdate(asn, adv, peerFamilies)
+		}
+		for family, routes := range partitionByFamily(withdraws) {
+			s.enqueueWithdraw(asn, family, peerFamilies, routes)
 		}
+		stats.AdvertisedPrefixes(s.addr, len(newAdvs))
+	}
+}
+
+// enqueueUpdate marshals and queues a BGP UPDATE advertising adv, unless
+// adv is in a family the peer never negotiated, in which case it's
+// dropped with a logged error: there's no NOTIFICATION we can usefully
+// send back for "you asked for a family you didn't ask for".
+func (s *Session) enqueueUpdate(asn uint32, adv *Advertisement, peerFamilies map[afiSafi]bool) {
+	if family := familyFor(adv.Prefix.IP); family == familyIPv6 && !peerFamilies[familyIPv6] {
+		glog.Errorf("BGP: peer %q did not negotiate IPv6 unicast, dropping advertisement of %q", s.addr, adv.Prefix)
+		return
+	}
+	s.enqueue(MarshalUpdate(asn, adv))
+	stats.UpdateSent(s.addr)
+	s.notifyUpdate(asn, adv)
+}
 
-		wdr := []*net.IPNet{}
-		for c, adv := range s.advertised {
-			if s.new[c] == nil {
-				wdr = append(wdr, adv.Prefix)
+// enqueueWithdraw marshals and queues one BGP UPDATE per prefix in
+// routes, withdrawing it. family is the address family of every prefix in
+// routes, as produced by partitionByFamily. asn is passed through to
+// observers for consistency with enqueueUpdate, though a withdrawal's
+// wire encoding doesn't depend on it.
+func (s *Session) enqueueWithdraw(asn uint32, family afiSafi, peerFamilies map[afiSafi]bool, routes []*net.IPNet) {
+	if len(routes) == 0 {
+		return
+	}
+	if family == familyIPv6 && !peerFamilies[familyIPv6] {
+		glog.Errorf("BGP: peer %q did not negotiate IPv6 unicast, dropping withdrawal of %d prefixes", s.addr, len(routes))
+		return
+	}
+	for _, r := range routes {
+		s.enqueue(MarshalWithdraw(r))
+		stats.UpdateSent(s.addr)
+		s.notifyWithdraw(asn, r)
+	}
+}
+
+// enqueue queues msg to be written to the session's current connection by
+// writeLoop. If the queue is already full - the peer isn't draining its
+// socket fast enough - msg is dropped rather than blocking the caller.
+func (s *Session) enqueue(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enqueueLocked(msg)
+}
+
+// enqueueLocked is enqueue for callers that already hold s.mu (e.g.
+// Reconfigure, which needs to queue a NOTIFICATION in the middle of
+// updating the session's config).
+//
+// s.mu is held across the (non-blocking) channel send so that this can
+// never race with abort() closing s.writeCh out from under us: the two
+// are fully serialized, so we never send on a channel abort has already
+// closed.
+func (s *Session) enqueueLocked(msg []byte) {
+	if s.writeCh == nil {
+		return
+	}
+
+	select {
+	case s.writeCh <- msg:
+		stats.QueueDepth(s.addr, len(s.writeCh))
+	default:
+		stats.MessageDropped(s.addr)
+	}
+}
+
+// writeLoop drains ch and writes each message to conn, until ch is closed
+// or a write fails. Messages already queued by the time a write starts
+// are coalesced into that same write, so a burst of updates costs one
+// syscall instead of many.
+func (s *Session) writeLoop(conn net.Conn, ch chan []byte) {
+	for msg := range ch {
+	drain:
+		for {
+			select {
+			case more, ok := <-ch:
+				if !ok {
+					break drain
+				}
+				msg = append(msg, more...)
+			default:
+				break drain
 			}
 		}
-		if len(wdr) > 0 {
-			if err := sendWithdraw(s.conn, wdr); err != nil {
-				s.abort()
-				return fmt.Errorf("sending withdraw of %q to %q: %s", wdr, s.addr, err)
+
+		start := time.Now()
+		_, err := conn.Write(msg)
+		stats.WriteLatency(s.addr, time.Since(start))
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.abort("write-error")
 			}
-			stats.UpdateSent(s.addr)
+			s.mu.Unlock()
+			return
 		}
-		s.advertised, s.new = s.new, nil
-		stats.AdvertisedPrefixes(s.addr, len(s.advertised))
 	}
 }
 
@@ -138,17 +348,31 @@ func (s *Session) connect() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	conn, err := net.Dial("tcp", s.addr)
+	var conn net.Conn
+	var err error
+	if s.password == "" {
+		conn, err = net.Dial("tcp", s.addr)
+	} else {
+		// The kernel must have TCP_MD5SIG/TCP_AO applied to the socket
+		// before the SYN goes out, so net.Dial's plain connect won't do.
+		conn, err = dialWithAuth(s.addr, s.password, s.authAlgorithm)
+	}
 	if err != nil {
+		if s.password != "" {
+			stats.AuthFailure(s.addr)
+		}
 		return fmt.Errorf("dial %q: %s", s.addr, err)
 	}
 
-	if err := sendOpen(conn, s.asn, s.routerID, s.holdTime); err != nil {
+	// Always offer multiprotocol IPv6 unicast, in addition to the
+	// always-present IPv4 unicast family: the peer is free to ignore the
+	// capability if it doesn't support it.
+	if err := sendOpen(conn, s.asn, s.routerID, s.holdTime, familyIPv6); err != nil {
 		conn.Close()
 		return fmt.Errorf("send OPEN to %q: %s", s.addr, err)
 	}
 
-	asn, requestedHold, err := readOpen(conn)
+	asn, requestedHold, peerFamilies, err := readOpen(conn)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("read OPEN from %q: %s", s.addr, err)
@@ -157,6 +381,7 @@ func (s *Session) connect() error {
 		conn.Close()
 		return fmt.Errorf("unexpected peer ASN %d, want %d", asn, s.peerASN)
 	}
+	s.peerFamilies = peerFamilies
 
 	// Consume BGP messages until the connection closes.
 	go s.consumeBGP(conn)
@@ -177,6 +402,10 @@ func (s *Session) connect() error {
 	default:
 	}
 
+	ch := make(chan []byte, writeQueueDepth)
+	s.writeCh = ch
+	go s.writeLoop(conn, ch)
+
 	s.conn = conn
 	return nil
 }
@@ -218,38 +447,64 @@ func (s *Session) sendKeepalives() {
 
 func (s *Session) sendKeepalive() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.closed {
+	closed := s.closed
+	noConn := s.conn == nil
+	s.mu.Unlock()
+	if closed {
 		return errClosed
 	}
-	if s.conn == nil {
-		// No connection established, othing to do.
+	if noConn {
+		// No connection established, nothing to do.
 		return nil
 	}
-	if err := sendKeepalive(s.conn); err != nil {
-		s.abort()
-		return fmt.Errorf("sending keepalive to %q: %s", s.addr, err)
-	}
+	s.enqueue(marshalKeepalive())
 	return nil
 }
 
-func New(addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration) (*Session, error) {
+// New creates a Session speaking to the BGP peer at addr. If bfd is
+// non-nil, a BFD session (RFC 5880) runs alongside the BGP session and
+// aborts it as soon as the peer is declared Down, which typically
+// happens in well under a second, rather than waiting out the BGP
+// holdtime. If password is non-empty, the session's TCP connection is
+// authenticated with it using authAlgorithm.
+func New(addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration, bfd *BFDConfig, password string, authAlgorithm AuthAlgorithm) (*Session, error) {
 	ret := &Session{
-		addr:        addr,
-		asn:         asn,
-		routerID:    routerID.To4(),
-		peerASN:     peerASN,
-		holdTime:    holdTime,
-		newHoldTime: make(chan bool, 1),
-		advertised:  map[string]*Advertisement{},
+		addr:          addr,
+		asn:           asn,
+		routerID:      routerID.To4(),
+		peerASN:       peerASN,
+		holdTime:      holdTime,
+		password:      password,
+		authAlgorithm: authAlgorithm,
+		newHoldTime:   make(chan bool, 1),
+		advertised:    map[string]*Advertisement{},
 	}
 	if ret.routerID == nil {
 		return nil, fmt.Errorf("invalid routerID %q, must be IPv4", routerID)
 	}
+	if bfd != nil && (bfd.MinTx <= 0 || bfd.MinRx <= 0 || bfd.DetectMult == 0) {
+		// A zero DetectMult/MinRx/MinTx makes detectionTime() return 0,
+		// which spins declareDown() in a tight loop instead of ever
+		// giving the peer a chance to respond.
+		return nil, fmt.Errorf("invalid BFDConfig %+v: MinTx, MinRx and DetectMult must all be non-zero", bfd)
+	}
 	ret.cond = sync.NewCond(&ret.mu)
 	go ret.sendKeepalives()
 	go ret.run()
 
+	if bfd != nil {
+		peerIP, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			peerIP = addr
+		}
+		ret.bfd = newBFDSession(peerIP, bfd, func() {
+			ret.mu.Lock()
+			defer ret.mu.Unlock()
+			ret.abort("bfd")
+		})
+		go ret.bfd.run()
+	}
+
 	stats.sessionUp.WithLabelValues(ret.addr).Set(0)
 	stats.prefixes.WithLabelValues(ret.addr).Set(0)
 
@@ -261,7 +516,7 @@ func (s *Session) consumeBGP(conn net.Conn) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		if s.conn == conn {
-			s.abort()
+			s.abort("holdtime")
 		} else {
 			conn.Close()
 		}
@@ -294,12 +549,10 @@ func (s *Session) Set(advs ...*Advertisement) error {
 
 	newAdvs := map[string]*Advertisement{}
 	for _, adv := range advs {
-		if adv.Prefix.IP.To4() == nil {
-			return fmt.Errorf("cannot advertise non-v4 prefix %q", adv.Prefix)
-		}
-
-		if adv.NextHop.To4() == nil {
-			return fmt.Errorf("next-hop must be IPv4, got %q", adv.NextHop)
+		prefixIsV4 := adv.Prefix.IP.To4() != nil
+		nextHopIsV4 := adv.NextHop.To4() != nil
+		if prefixIsV4 != nextHopIsV4 {
+			return fmt.Errorf("prefix %q and next-hop %q must be the same IP family", adv.Prefix, adv.NextHop)
 		}
 		if len(adv.Communities) > 63 {
 			return fmt.Errorf("max supported communities is 63, got %d", len(adv.Communities))
@@ -313,11 +566,17 @@ func (s *Session) Set(advs ...*Advertisement) error {
 	return nil
 }
 
-func (s *Session) abort() {
+// abort tears down the session's TCP connection. reason records why, so
+// operators can tell a slow holdtime-expiry teardown apart from a
+// sub-second BFD-triggered one in the exported metrics.
+func (s *Session) abort(reason string) {
 	if s.conn != nil {
 		s.conn.Close()
 		s.conn = nil
+		close(s.writeCh)
+		s.writeCh = nil
 		stats.SessionDown(s.addr)
+		stats.TeardownReason(s.addr, reason)
 	}
 	// Next time we retry the connection, we can just skip straight to
 	// the desired end state.
@@ -332,13 +591,85 @@ func (s *Session) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.closed = true
-	s.abort()
+	s.abort("closed")
+	if s.bfd != nil {
+		s.bfd.stop()
+	}
 	return nil
 }
 
+// SessionConfig holds the peer parameters that Reconfigure can apply to a
+// running Session. It's intentionally a plain copy of the fields New
+// takes, so that a caller re-reading its config (e.g. in a SIGHUP
+// handler) can just build one from the new MetalLB ConfigMap and hand it
+// to Reconfigure.
+type SessionConfig struct {
+	PeerAddr      string
+	MyASN         uint32
+	RouterID      net.IP
+	PeerASN       uint32
+	HoldTime      time.Duration
+	Password      string
+	AuthAlgorithm AuthAlgorithm
+}
+
+// Reconfigure updates the peer parameters of a running Session. Changes
+// that BGP can renegotiate without dropping the TCP connection - right
+// now, just the holdtime, which is exchanged fresh on every OPEN - take
+// effect the next time the session reconnects on its own. Changes that
+// require a brand new connection (peer address, either AS number, router
+// ID, or the auth password/algorithm, since TCP-MD5/TCP-AO must be set on
+// the socket before the SYN) make Reconfigure queue a NOTIFICATION with
+// subcode "Other Configuration Change" (RFC 4486) and reconnect
+// immediately.
+func (s *Session) Reconfigure(cfg SessionConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	needsReconnect := cfg.PeerAddr != s.addr ||
+		cfg.MyASN != s.asn ||
+		cfg.PeerASN != s.peerASN ||
+		!cfg.RouterID.Equal(s.routerID) ||
+		cfg.Password != s.password ||
+		cfg.AuthAlgorithm != s.authAlgorithm
+
+	if cfg.PeerAddr != s.addr {
+		// The gauges are keyed by peer address, so a change of address
+		// otherwise orphans the old series at whatever value abort()
+		// last left it, instead of reflecting the new session.
+		stats.DeleteSession(s.addr)
+	}
+
+	s.addr = cfg.PeerAddr
+	s.asn = cfg.MyASN
+	s.peerASN = cfg.PeerASN
+	s.routerID = cfg.RouterID.To4()
+	s.holdTime = cfg.HoldTime
+	s.password = cfg.Password
+	s.authAlgorithm = cfg.AuthAlgorithm
+
+	if !needsReconnect {
+		return nil
+	}
+
+	// Queue the NOTIFICATION through the same writer goroutine as
+	// everything else, rather than writing to the socket directly here:
+	// a slow or unresponsive peer must not be able to stall every other
+	// call into this Session behind s.mu.
+	if s.conn != nil {
+		s.enqueueLocked(marshalNotification(notifCease, notifSubcodeConfigChange))
+	}
+	s.abort("reconfigure")
+	return nil
+}
+
+// Advertisement describes one network prefix to advertise to a peer.
+// Prefix and NextHop must be the same IP family: both IPv4, or both
+// IPv6. IPv6 advertisements are only delivered to peers that negotiated
+// the Multiprotocol Extensions capability (RFC 4760) for IPv6 unicast.
 type Advertisement struct {
 	Prefix      *net.IPNet
 	NextHop     net.IP
 	LocalPref   uint32
 	Communities []uint32
-}
\ No newline at end of file
+}
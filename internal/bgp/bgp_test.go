@@ -0,0 +1,204 @@
+package bgp
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func sortedPrefixes(ns []*net.IPNet) []string {
+	out := make([]string, 0, len(ns))
+	for _, n := range ns {
+		out = append(out, n.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func sortedAdvs(advs []*Advertisement) []string {
+	out := make([]string, 0, len(advs))
+	for _, a := range advs {
+		out = append(out, a.Prefix.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDiffAdvertisementsNewPeer(t *testing.T) {
+	new := map[string]*Advertisement{
+		"10.0.0.0/24": {Prefix: mustCIDR("10.0.0.0/24"), NextHop: net.ParseIP("10.0.0.1")},
+	}
+
+	updates, withdraws := diffAdvertisements(nil, new)
+
+	if got := sortedAdvs(updates); !reflect.DeepEqual(got, []string{"10.0.0.0/24"}) {
+		t.Errorf("got updates %v, want [10.0.0.0/24]", got)
+	}
+	if len(withdraws) != 0 {
+		t.Errorf("got withdraws %v, want none", withdraws)
+	}
+}
+
+func TestDiffAdvertisementsUnchanged(t *testing.T) {
+	adv := &Advertisement{Prefix: mustCIDR("10.0.0.0/24"), NextHop: net.ParseIP("10.0.0.1"), Communities: []uint32{1234}}
+	old := map[string]*Advertisement{"10.0.0.0/24": adv}
+	new := map[string]*Advertisement{"10.0.0.0/24": adv}
+
+	updates, withdraws := diffAdvertisements(old, new)
+
+	if len(updates) != 0 {
+		t.Errorf("got updates %v, want none, advertisement is unchanged", updates)
+	}
+	if len(withdraws) != 0 {
+		t.Errorf("got withdraws %v, want none", withdraws)
+	}
+}
+
+func TestDiffAdvertisementsChangedNextHop(t *testing.T) {
+	old := map[string]*Advertisement{
+		"10.0.0.0/24": {Prefix: mustCIDR("10.0.0.0/24"), NextHop: net.ParseIP("10.0.0.1")},
+	}
+	new := map[string]*Advertisement{
+		"10.0.0.0/24": {Prefix: mustCIDR("10.0.0.0/24"), NextHop: net.ParseIP("10.0.0.2")},
+	}
+
+	updates, withdraws := diffAdvertisements(old, new)
+
+	if got := sortedAdvs(updates); !reflect.DeepEqual(got, []string{"10.0.0.0/24"}) {
+		t.Errorf("got updates %v, want [10.0.0.0/24], next-hop changed", got)
+	}
+	if len(withdraws) != 0 {
+		t.Errorf("got withdraws %v, want none", withdraws)
+	}
+}
+
+func TestDiffAdvertisementsWithdraw(t *testing.T) {
+	old := map[string]*Advertisement{
+		"10.0.0.0/24": {Prefix: mustCIDR("10.0.0.0/24"), NextHop: net.ParseIP("10.0.0.1")},
+		"10.0.1.0/24": {Prefix: mustCIDR("10.0.1.0/24"), NextHop: net.ParseIP("10.0.0.1")},
+	}
+	new := map[string]*Advertisement{
+		"10.0.0.0/24": old["10.0.0.0/24"],
+	}
+
+	updates, withdraws := diffAdvertisements(old, new)
+
+	if len(updates) != 0 {
+		t.Errorf("got updates %v, want none", updates)
+	}
+	if got := sortedPrefixes(withdraws); !reflect.DeepEqual(got, []string{"10.0.1.0/24"}) {
+		t.Errorf("got withdraws %v, want [10.0.1.0/24]", got)
+	}
+}
+
+// TestEnqueueNoRaceWithClose is a regression test for a send-on-closed-
+// channel panic: enqueue used to read s.writeCh under s.mu but send to it
+// outside the lock, so a concurrent abort() closing the channel could
+// race a send in flight. enqueue now holds s.mu across the send, so this
+// must run clean under go test -race, with no panic.
+func TestEnqueueNoRaceWithClose(t *testing.T) {
+	s := &Session{addr: "10.0.0.1:179"}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.enqueue([]byte("msg"))
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		s.mu.Lock()
+		if s.writeCh != nil {
+			close(s.writeCh)
+		}
+		s.writeCh = make(chan []byte, 1)
+		s.mu.Unlock()
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func newTestSession() *Session {
+	s := &Session{
+		addr:     "10.0.0.1:179",
+		asn:      100,
+		peerASN:  200,
+		routerID: net.ParseIP("1.2.3.4").To4(),
+		holdTime: 90 * time.Second,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func TestReconfigureUpdatesAddress(t *testing.T) {
+	s := newTestSession()
+
+	cfg := SessionConfig{
+		PeerAddr: "10.0.0.2:179",
+		MyASN:    s.asn,
+		PeerASN:  s.peerASN,
+		RouterID: s.routerID,
+		HoldTime: s.holdTime,
+	}
+
+	if err := s.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %s", err)
+	}
+	if s.addr != cfg.PeerAddr {
+		t.Errorf("got addr %q, want %q", s.addr, cfg.PeerAddr)
+	}
+}
+
+func TestReconfigureHoldTimeOnlyDoesNotTouchConn(t *testing.T) {
+	s := newTestSession()
+
+	cfg := SessionConfig{
+		PeerAddr: s.addr,
+		MyASN:    s.asn,
+		PeerASN:  s.peerASN,
+		RouterID: s.routerID,
+		HoldTime: 30 * time.Second,
+	}
+
+	// s.conn is nil; a holdtime-only change shouldn't need a reconnect,
+	// so this must not try to queue a NOTIFICATION or otherwise assume a
+	// live connection.
+	if err := s.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %s", err)
+	}
+	if s.holdTime != 30*time.Second {
+		t.Errorf("got holdTime %s, want 30s", s.holdTime)
+	}
+}
+
+func TestNewRejectsZeroBFDConfig(t *testing.T) {
+	// A zero DetectMult, MinTx or MinRx would make detectionTime() return
+	// 0 and spin declareDown() forever, so New must reject it before
+	// starting any goroutines (i.e. without needing a live connection to
+	// the bogus peer address below).
+	_, err := New("198.51.100.1:179", 100, net.ParseIP("1.2.3.4"), 200, 90*time.Second, &BFDConfig{MinTx: time.Second, MinRx: time.Second}, "", AuthNone)
+	if err == nil {
+		t.Fatal("New with a zero DetectMult succeeded, want an error")
+	}
+}
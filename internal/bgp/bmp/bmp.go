@@ -0,0 +1,168 @@
+// Package bmp encodes BMP (BGP Monitoring Protocol, RFC 7854) messages,
+// and provides an Exporter that streams them to one or more BMP
+// collectors (pmacct, OpenBMP, Cisco Crosswork, ...) by observing a
+// bgp.Session.
+package bmp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// BMP message types, RFC 7854 section 4.2.
+const (
+	MsgTypeRouteMonitoring      = 0
+	MsgTypeStatisticsReport     = 1
+	MsgTypePeerDownNotification = 2
+	MsgTypePeerUpNotification   = 3
+	MsgTypeInitiation           = 4
+	MsgTypeTermination          = 5
+)
+
+const bmpVersion = 3
+
+// encodeCommonHeader encodes the BMP Common Header (RFC 7854 section
+// 4.1) for a message of the given type whose body is body.
+func encodeCommonHeader(msgType uint8, body []byte) []byte {
+	buf := make([]byte, 6+len(body))
+	buf[0] = bmpVersion
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(buf)))
+	buf[5] = msgType
+	copy(buf[6:], body)
+	return buf
+}
+
+// PeerHeader flags, RFC 7854 section 4.2.
+const (
+	peerFlagV = 1 << 7 // peer address is IPv6
+)
+
+// PerPeerHeader identifies the monitored BGP peer a BMP message is
+// about, RFC 7854 section 4.2.
+type PerPeerHeader struct {
+	PeerAddress net.IP
+	PeerAS      uint32
+	PeerBGPID   net.IP
+	Timestamp   time.Time
+}
+
+// Marshal encodes the 42-byte Per-Peer Header.
+func (h PerPeerHeader) Marshal() []byte {
+	buf := make([]byte, 42)
+	// buf[0] is Peer Type, 0 (Global Instance Peer) for every peer we
+	// monitor.
+
+	var flags uint8
+	addr := h.PeerAddress.To4()
+	if addr == nil {
+		flags |= peerFlagV
+		addr = h.PeerAddress.To16()
+	}
+	buf[1] = flags
+	// buf[2:10] is the Peer Distinguisher, which we always leave zero:
+	// MetalLB has no concept of multiple routing instances per peer.
+
+	if flags&peerFlagV != 0 {
+		copy(buf[10:26], addr)
+	} else {
+		copy(buf[22:26], addr)
+	}
+
+	binary.BigEndian.PutUint32(buf[26:30], h.PeerAS)
+	copy(buf[30:34], h.PeerBGPID.To4())
+
+	if !h.Timestamp.IsZero() {
+		binary.BigEndian.PutUint32(buf[34:38], uint32(h.Timestamp.Unix()))
+		binary.BigEndian.PutUint32(buf[38:42], uint32(h.Timestamp.Nanosecond()/1000))
+	}
+
+	return buf
+}
+
+// RouteMonitoring wraps a raw BGP UPDATE PDU (e.g. from bgp.MarshalUpdate
+// or bgp.MarshalWithdraw) in a Route Monitoring message, RFC 7854 section
+// 4.6.
+func RouteMonitoring(ph PerPeerHeader, bgpUpdate []byte) []byte {
+	body := append(ph.Marshal(), bgpUpdate...)
+	return encodeCommonHeader(MsgTypeRouteMonitoring, body)
+}
+
+// PeerUpNotification builds a Peer Up Notification, RFC 7854 section
+// 4.10, carrying the OPEN messages exchanged when the session came up.
+func PeerUpNotification(ph PerPeerHeader, localAddr net.IP, localPort, remotePort uint16, sentOpen, receivedOpen []byte) []byte {
+	body := ph.Marshal()
+
+	addrField := make([]byte, 16)
+	if v4 := localAddr.To4(); v4 != nil {
+		copy(addrField[12:], v4)
+	} else {
+		copy(addrField, localAddr.To16())
+	}
+	body = append(body, addrField...)
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], localPort)
+	binary.BigEndian.PutUint16(ports[2:4], remotePort)
+	body = append(body, ports...)
+
+	body = append(body, sentOpen...)
+	body = append(body, receivedOpen...)
+
+	return encodeCommonHeader(MsgTypePeerUpNotification, body)
+}
+
+// Peer Down Notification reasons, RFC 7854 section 4.9.
+const (
+	PeerDownLocalNotify    = 1 // Local system closed, NOTIFICATION PDU follows
+	PeerDownLocalNoNotify  = 2 // Local system closed, no NOTIFICATION
+	PeerDownRemoteNotify   = 3 // Remote system closed, NOTIFICATION PDU follows
+	PeerDownRemoteNoNotify = 4 // Remote system closed, no NOTIFICATION
+)
+
+// PeerDownNotification builds a Peer Down Notification, RFC 7854 section
+// 4.9.
+func PeerDownNotification(ph PerPeerHeader, reason uint8, data []byte) []byte {
+	body := append(ph.Marshal(), reason)
+	body = append(body, data...)
+	return encodeCommonHeader(MsgTypePeerDownNotification, body)
+}
+
+// Statistics Report TLV types we emit. Types 0-13 are the ones IANA has
+// standardized in RFC 7854/8671; 65531-65534 are reserved for
+// experimental use, which is where we put MetalLB-specific counters that
+// don't map onto a standard type.
+const (
+	StatTypeAdjRIBOut               = 5 // RFC 7854: routes in post-policy Adj-RIB-Out
+	StatTypeUpdatesSentExperimental = 65531
+)
+
+// Stat is one Type/Length/Value entry in a Statistics Report.
+type Stat struct {
+	Type  uint16
+	Value uint64
+}
+
+func (s Stat) marshal() []byte {
+	buf := make([]byte, 4+8)
+	binary.BigEndian.PutUint16(buf[0:2], s.Type)
+	binary.BigEndian.PutUint16(buf[2:4], 8)
+	binary.BigEndian.PutUint64(buf[4:12], s.Value)
+	return buf
+}
+
+// StatisticsReport builds a Statistics Report, RFC 7854 section 4.8,
+// carrying one TLV per entry in stats.
+func StatisticsReport(ph PerPeerHeader, stats []Stat) []byte {
+	body := ph.Marshal()
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(stats)))
+	body = append(body, count...)
+
+	for _, st := range stats {
+		body = append(body, st.marshal()...)
+	}
+
+	return encodeCommonHeader(MsgTypeStatisticsReport, body)
+}
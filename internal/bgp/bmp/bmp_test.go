@@ -0,0 +1,126 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestEncodeCommonHeader(t *testing.T) {
+	body := []byte{1, 2, 3}
+	got := encodeCommonHeader(MsgTypeRouteMonitoring, body)
+
+	if len(got) != 9 {
+		t.Fatalf("got length %d, want 9", len(got))
+	}
+	if got[0] != bmpVersion {
+		t.Errorf("got version %d, want %d", got[0], bmpVersion)
+	}
+	if gotLen := binary.BigEndian.Uint32(got[1:5]); gotLen != 9 {
+		t.Errorf("got encoded length %d, want 9", gotLen)
+	}
+	if got[5] != MsgTypeRouteMonitoring {
+		t.Errorf("got message type %d, want %d", got[5], MsgTypeRouteMonitoring)
+	}
+	if !bytes.Equal(got[6:], body) {
+		t.Errorf("got body %v, want %v", got[6:], body)
+	}
+}
+
+func TestPerPeerHeaderMarshalIPv4(t *testing.T) {
+	ph := PerPeerHeader{
+		PeerAddress: net.ParseIP("10.0.0.1"),
+		PeerAS:      64512,
+		PeerBGPID:   net.ParseIP("10.0.0.254"),
+	}
+	buf := ph.Marshal()
+
+	if len(buf) != 42 {
+		t.Fatalf("got length %d, want 42", len(buf))
+	}
+	if buf[1]&peerFlagV != 0 {
+		t.Errorf("V flag set for an IPv4 peer address")
+	}
+	if gotAddr := net.IP(buf[22:26]); !gotAddr.Equal(ph.PeerAddress) {
+		t.Errorf("got peer address %v, want %v", gotAddr, ph.PeerAddress)
+	}
+	if gotAS := binary.BigEndian.Uint32(buf[26:30]); gotAS != ph.PeerAS {
+		t.Errorf("got peer AS %d, want %d", gotAS, ph.PeerAS)
+	}
+	if gotID := net.IP(buf[30:34]); !gotID.Equal(ph.PeerBGPID) {
+		t.Errorf("got peer BGP ID %v, want %v", gotID, ph.PeerBGPID)
+	}
+}
+
+func TestPerPeerHeaderMarshalIPv6(t *testing.T) {
+	ph := PerPeerHeader{
+		PeerAddress: net.ParseIP("2001:db8::1"),
+		PeerAS:      64512,
+		PeerBGPID:   net.ParseIP("10.0.0.254"),
+	}
+	buf := ph.Marshal()
+
+	if buf[1]&peerFlagV == 0 {
+		t.Errorf("V flag not set for an IPv6 peer address")
+	}
+	if gotAddr := net.IP(buf[10:26]); !gotAddr.Equal(ph.PeerAddress) {
+		t.Errorf("got peer address %v, want %v", gotAddr, ph.PeerAddress)
+	}
+}
+
+func TestRouteMonitoring(t *testing.T) {
+	ph := PerPeerHeader{PeerAddress: net.ParseIP("10.0.0.1"), PeerAS: 64512, PeerBGPID: net.ParseIP("10.0.0.254")}
+	update := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	got := RouteMonitoring(ph, update)
+
+	if got[5] != MsgTypeRouteMonitoring {
+		t.Errorf("got message type %d, want %d", got[5], MsgTypeRouteMonitoring)
+	}
+	if !bytes.Equal(got[len(got)-len(update):], update) {
+		t.Errorf("encoded message doesn't end with the BGP UPDATE bytes")
+	}
+	if wantLen := 6 + 42 + len(update); len(got) != wantLen {
+		t.Errorf("got length %d, want %d", len(got), wantLen)
+	}
+}
+
+func TestStatisticsReport(t *testing.T) {
+	ph := PerPeerHeader{PeerAddress: net.ParseIP("10.0.0.1"), PeerAS: 64512, PeerBGPID: net.ParseIP("10.0.0.254")}
+	stats := []Stat{
+		{Type: StatTypeAdjRIBOut, Value: 3},
+		{Type: StatTypeUpdatesSentExperimental, Value: 42},
+	}
+
+	got := StatisticsReport(ph, stats)
+
+	statsCount := binary.BigEndian.Uint32(got[6+42 : 6+42+4])
+	if int(statsCount) != len(stats) {
+		t.Fatalf("got stats count %d, want %d", statsCount, len(stats))
+	}
+
+	tlv := got[6+42+4:]
+	for _, want := range stats {
+		gotType := binary.BigEndian.Uint16(tlv[0:2])
+		gotLen := binary.BigEndian.Uint16(tlv[2:4])
+		gotValue := binary.BigEndian.Uint64(tlv[4:12])
+		if gotType != want.Type || gotLen != 8 || gotValue != want.Value {
+			t.Errorf("got TLV {%d, %d, %d}, want {%d, 8, %d}", gotType, gotLen, gotValue, want.Type, want.Value)
+		}
+		tlv = tlv[12:]
+	}
+}
+
+func TestPeerDownNotification(t *testing.T) {
+	ph := PerPeerHeader{PeerAddress: net.ParseIP("10.0.0.1"), PeerAS: 64512, PeerBGPID: net.ParseIP("10.0.0.254")}
+
+	got := PeerDownNotification(ph, PeerDownLocalNoNotify, nil)
+
+	if got[5] != MsgTypePeerDownNotification {
+		t.Errorf("got message type %d, want %d", got[5], MsgTypePeerDownNotification)
+	}
+	if gotReason := got[6+42]; gotReason != PeerDownLocalNoNotify {
+		t.Errorf("got reason %d, want %d", gotReason, PeerDownLocalNoNotify)
+	}
+}
@@ -0,0 +1,158 @@
+package bmp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"go.universe.tf/metallb/internal/bgp"
+)
+
+// statsInterval is how often the Exporter emits a Statistics Report for
+// each peer it's observing.
+const statsInterval = 30 * time.Second
+
+// Exporter observes one or more bgp.Sessions (via AddObserver) and
+// streams what it sees to a set of BMP collectors as Route Monitoring,
+// Peer Up/Down, and Statistics Report messages.
+type Exporter struct {
+	mu       sync.Mutex
+	stations []net.Conn
+
+	peersMu sync.Mutex
+	peers   map[string]PerPeerHeader
+
+	stop chan struct{}
+}
+
+// NewExporter dials each of the given BMP collector addresses and
+// returns an Exporter ready to be registered with bgp.Session.AddObserver.
+func NewExporter(collectors ...string) (*Exporter, error) {
+	e := &Exporter{
+		peers: map[string]PerPeerHeader{},
+		stop:  make(chan struct{}),
+	}
+	for _, addr := range collectors {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.stations = append(e.stations, conn)
+	}
+	go e.reportLoop()
+	return e, nil
+}
+
+// Close stops the periodic Statistics Reports and disconnects from every
+// collector.
+func (e *Exporter) Close() {
+	close(e.stop)
+	for _, c := range e.stations {
+		c.Close()
+	}
+}
+
+func (e *Exporter) broadcast(msg []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range e.stations {
+		if _, err := c.Write(msg); err != nil {
+			glog.Errorf("BMP: writing to collector %q: %s", c.RemoteAddr(), err)
+		}
+	}
+}
+
+func peerHeader(peer string, peerASN uint32) PerPeerHeader {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	return PerPeerHeader{
+		PeerAddress: net.ParseIP(host),
+		PeerAS:      peerASN,
+		// MetalLB doesn't know its peer's router ID until the OPEN
+		// exchange completes; until then, report the zero address.
+		PeerBGPID: net.IPv4zero,
+		Timestamp: time.Now(),
+	}
+}
+
+// OnPeerUp implements bgp.Observer.
+func (e *Exporter) OnPeerUp(peer string, peerASN, localASN uint32, routerID net.IP) {
+	ph := peerHeader(peer, peerASN)
+	ph.PeerBGPID = routerID
+
+	e.peersMu.Lock()
+	e.peers[peer] = ph
+	e.peersMu.Unlock()
+
+	e.broadcast(PeerUpNotification(ph, net.IPv4zero, 0, 0, nil, nil))
+}
+
+// OnPeerDown implements bgp.Observer.
+func (e *Exporter) OnPeerDown(peer string) {
+	ph := e.peerHeaderFor(peer)
+
+	e.peersMu.Lock()
+	delete(e.peers, peer)
+	e.peersMu.Unlock()
+
+	e.broadcast(PeerDownNotification(ph, PeerDownLocalNoNotify, nil))
+}
+
+// OnUpdate implements bgp.Observer. asn is the AS the UPDATE's AS_PATH was
+// actually encoded with, not necessarily the peer's own ASN - using the
+// latter would make the mirrored Route Monitoring message diverge from
+// the one actually sent (wrong AS_PATH for eBGP, missing LOCAL_PREF for
+// iBGP).
+func (e *Exporter) OnUpdate(peer string, asn uint32, adv *bgp.Advertisement) {
+	ph := e.peerHeaderFor(peer)
+	e.broadcast(RouteMonitoring(ph, bgp.MarshalUpdate(asn, adv)))
+}
+
+// OnWithdraw implements bgp.Observer.
+func (e *Exporter) OnWithdraw(peer string, asn uint32, prefix *net.IPNet) {
+	ph := e.peerHeaderFor(peer)
+	e.broadcast(RouteMonitoring(ph, bgp.MarshalWithdraw(prefix)))
+}
+
+func (e *Exporter) peerHeaderFor(peer string) PerPeerHeader {
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	if ph, ok := e.peers[peer]; ok {
+		return ph
+	}
+	return peerHeader(peer, 0)
+}
+
+// reportLoop periodically emits a Statistics Report for every peer
+// currently up, built from the same Prometheus counters the metrics
+// endpoint exposes.
+func (e *Exporter) reportLoop() {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-t.C:
+			e.peersMu.Lock()
+			peers := make(map[string]PerPeerHeader, len(e.peers))
+			for k, v := range e.peers {
+				peers[k] = v
+			}
+			e.peersMu.Unlock()
+
+			for peer, ph := range peers {
+				stats := []Stat{
+					{Type: StatTypeUpdatesSentExperimental, Value: bgp.UpdatesSent(peer)},
+				}
+				e.broadcast(StatisticsReport(ph, stats))
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// BGP message types, RFC 4271.
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+// Address family / subsequent address family identifiers, RFC 4760.
+const (
+	afiIPv4 = 1
+	afiIPv6 = 2
+
+	safiUnicast = 1
+)
+
+// BGP capability codes, RFC 5492.
+const (
+	capMultiprotocol = 1
+)
+
+// BGP NOTIFICATION error codes, RFC 4271 section 4.5, and the Cease
+// subcodes from RFC 4486.
+const (
+	notifCease               = 6
+	notifSubcodeConfigChange = 6
+)
+
+// BGP path attribute type codes, RFC 4271 and RFC 4760.
+const (
+	attrOrigin        = 1
+	attrASPath        = 2
+	attrNextHop       = 3
+	attrLocalPref     = 5
+	attrCommunities   = 8
+	attrMPReachNLRI   = 14
+	attrMPUnreachNLRI = 15
+)
+
+const (
+	attrFlagOptional   = 1 << 7
+	attrFlagTransitive = 1 << 6
+)
+
+// afiSafi identifies a BGP address family, as carried in the
+// Multiprotocol Extensions capability and the MP_REACH_NLRI /
+// MP_UNREACH_NLRI path attributes.
+type afiSafi struct {
+	afi  uint16
+	safi uint8
+}
+
+var (
+	familyIPv4 = afiSafi{afiIPv4, safiUnicast}
+	familyIPv6 = afiSafi{afiIPv6, safiUnicast}
+)
+
+// familyFor returns the address family of ip.
+func familyFor(ip net.IP) afiSafi {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+type header struct {
+	Marker1, Marker2 uint64
+	Len              uint16
+	Type             uint8
+}
+
+func writeMessage(w io.Writer, typ uint8, body []byte) error {
+	hdr := header{
+		Marker1: 0xffffffffffffffff,
+		Marker2: 0xffffffffffffffff,
+		Len:     uint16(19 + len(body)),
+		Type:    typ,
+	}
+	if err := binary.Write(w, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// sendOpen sends a BGP OPEN message for asn/routerID/holdTime, advertising
+// the Multiprotocol Extensions capability (RFC 4760) for IPv4 unicast plus
+// any extra families the caller wants to negotiate (e.g. IPv6 unicast, so
+// that IPv6 service addresses can be advertised over this session).
+func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration, extraFamilies ...afiSafi) error {
+	caps := &bytes.Buffer{}
+	families := append([]afiSafi{familyIPv4}, extraFamilies...)
+	for _, f := range families {
+		mp := &bytes.Buffer{}
+		binary.Write(mp, binary.BigEndian, f.afi)
+		mp.WriteByte(0) // reserved
+		mp.WriteByte(f.safi)
+
+		capBuf := &bytes.Buffer{}
+		capBuf.WriteByte(capMultiprotocol)
+		capBuf.WriteByte(uint8(mp.Len()))
+		capBuf.Write(mp.Bytes())
+
+		caps.WriteByte(2) // optional parameter type: Capabilities
+		caps.WriteByte(uint8(capBuf.Len()))
+		caps.Write(capBuf.Bytes())
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteByte(4) // BGP version
+	binary.Write(body, binary.BigEndian, uint16(asn))
+	binary.Write(body, binary.BigEndian, uint16(holdTime/time.Second))
+	body.Write(routerID.To4())
+	body.WriteByte(uint8(caps.Len()))
+	body.Write(caps.Bytes())
+
+	return writeMessage(w, msgOpen, body.Bytes())
+}
+
+// readOpen reads a BGP OPEN message and returns the peer's ASN, requested
+// hold time, and the set of address families it advertised support for via
+// the Multiprotocol Extensions capability. IPv4 unicast is always included,
+// since legacy peers that never heard of RFC 4760 still speak it.
+func readOpen(r io.Reader) (asn uint32, holdTime time.Duration, families map[afiSafi]bool, err error) {
+	var hdr header
+	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return 0, 0, nil, err
+	}
+	if hdr.Marker1 != 0xffffffffffffffff || hdr.Marker2 != 0xffffffffffffffff {
+		return 0, 0, nil, fmt.Errorf("malformed BGP header, bad marker")
+	}
+	if hdr.Type != msgOpen {
+		return 0, 0, nil, fmt.Errorf("got BGP message type %d, want OPEN", hdr.Type)
+	}
+	if hdr.Len < 29 {
+		return 0, 0, nil, fmt.Errorf("malformed OPEN, too short")
+	}
+
+	body := make([]byte, hdr.Len-19)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	peerASN := binary.BigEndian.Uint16(body[1:3])
+	reqHold := binary.BigEndian.Uint16(body[3:5])
+
+	families = map[afiSafi]bool{familyIPv4: true}
+
+	optLen := int(body[9])
+	opts := body[10:]
+	if len(opts) < optLen {
+		return 0, 0, nil, fmt.Errorf("malformed OPEN, optional parameters truncated")
+	}
+	opts = opts[:optLen]
+
+	for len(opts) >= 2 {
+		typ, l := opts[0], int(opts[1])
+		if len(opts) < 2+l {
+			return 0, 0, nil, fmt.Errorf("malformed OPEN, optional parameter truncated")
+		}
+		val := opts[2 : 2+l]
+		if typ == 2 { // Capabilities
+			for len(val) >= 2 {
+				code, cl := val[0], int(val[1])
+				if len(val) < 2+cl {
+					break
+				}
+				if code == capMultiprotocol && cl == 4 {
+					families[afiSafi{binary.BigEndian.Uint16(val[2:4]), val[5]}] = true
+				}
+				val = val[2+cl:]
+			}
+		}
+		opts = opts[2+l:]
+	}
+
+	return uint32(peerASN), time.Duration(reqHold) * time.Second, families, nil
+}
+
+// partitionByFamily splits routes by address family, so callers can send one
+// withdrawal per AFI/SAFI as required by RFC 4760.
+func partitionByFamily(routes []*net.IPNet) map[afiSafi][]*net.IPNet {
+	out := map[afiSafi][]*net.IPNet{familyIPv4: nil, familyIPv6: nil}
+	for _, r := range routes {
+		f := familyFor(r.IP)
+		out[f] = append(out[f], r)
+	}
+	return out
+}
+
+func sendKeepalive(w io.Writer) error {
+	return writeMessage(w, msgKeepalive, nil)
+}
+
+// marshalKeepalive returns the wire bytes of a KEEPALIVE message, for
+// callers that queue messages for a writer goroutine rather than writing
+// straight to a connection.
+func marshalKeepalive() []byte {
+	buf := &bytes.Buffer{}
+	sendKeepalive(buf) // never fails writing to a bytes.Buffer
+	return buf.Bytes()
+}
+
+// sendNotification sends a BGP NOTIFICATION, which the receiving peer
+// must treat as an immediate, graceful request to tear down the session.
+func sendNotification(w io.Writer, errCode, errSubcode uint8) error {
+	return writeMessage(w, msgNotification, []byte{errCode, errSubcode})
+}
+
+// marshalNotification returns the wire bytes of a NOTIFICATION message,
+// for callers that queue messages for a writer goroutine rather than
+// writing straight to a connection.
+func marshalNotification(errCode, errSubcode uint8) []byte {
+	buf := &bytes.Buffer{}
+	sendNotification(buf, errCode, errSubcode) // never fails writing to a bytes.Buffer
+	return buf.Bytes()
+}
+
+func writeAttr(buf *bytes.Buffer, flags, typ uint8, value []byte) {
+	buf.WriteByte(flags)
+	buf.WriteByte(typ)
+	buf.WriteByte(uint8(len(value)))
+	buf.Write(value)
+}
+
+func commonAttrs(asn uint32, adv *Advertisement) []byte {
+	buf := &bytes.Buffer{}
+
+	writeAttr(buf, attrFlagTransitive, attrOrigin, []byte{0}) // IGP
+
+	asPath := &bytes.Buffer{}
+	if asn == 0 {
+		// iBGP, empty AS_PATH.
+		asPath.WriteByte(0)
+		asPath.WriteByte(0)
+	} else {
+		asPath.WriteByte(2) // AS_SEQUENCE
+		asPath.WriteByte(1)
+		binary.Write(asPath, binary.BigEndian, uint16(asn))
+	}
+	writeAttr(buf, attrFlagTransitive, attrASPath, asPath.Bytes())
+
+	if asn == 0 {
+		lp := make([]byte, 4)
+		binary.BigEndian.PutUint32(lp, adv.LocalPref)
+		writeAttr(buf, attrFlagTransitive, attrLocalPref, lp)
+	}
+
+	if len(adv.Communities) > 0 {
+		comms := &bytes.Buffer{}
+		for _, c := range adv.Communities {
+			binary.Write(comms, binary.BigEndian, c)
+		}
+		writeAttr(buf, attrFlagOptional|attrFlagTransitive, attrCommunities, comms.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func encodeNLRI(n *net.IPNet) []byte {
+	ones, _ := n.Mask.Size()
+	nBytes := (ones + 7) / 8
+
+	// n.IP may be either the 4-byte or the 16-byte (IPv4-in-IPv6) form of
+	// an IPv4 address depending on how the caller built it; normalize to
+	// 4 bytes so nBytes always indexes into the real address bytes
+	// rather than a v4-mapped IPv6 prefix.
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+
+	return append([]byte{uint8(ones)}, ip[:nBytes]...)
+}
+
+func sendUpdateV4(w io.Writer, asn uint32, adv *Advertisement) error {
+	attrs := &bytes.Buffer{}
+	attrs.Write(commonAttrs(asn, adv))
+	writeAttr(attrs, attrFlagTransitive, attrNextHop, adv.NextHop.To4())
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(0)) // withdrawn routes length
+	binary.Write(body, binary.BigEndian, uint16(attrs.Len()))
+	body.Write(attrs.Bytes())
+	body.Write(encodeNLRI(adv.Prefix))
+
+	return writeMessage(w, msgUpdate, body.Bytes())
+}
+
+func sendUpdateV6(w io.Writer, asn uint32, adv *Advertisement) error {
+	nextHop := adv.NextHop.To16()
+
+	mp := &bytes.Buffer{}
+	binary.Write(mp, binary.BigEndian, familyIPv6.afi)
+	mp.WriteByte(familyIPv6.safi)
+	mp.WriteByte(uint8(len(nextHop)))
+	mp.Write(nextHop)
+	mp.WriteByte(0) // SNPA count
+	mp.Write(encodeNLRI(adv.Prefix))
+
+	attrs := &bytes.Buffer{}
+	attrs.Write(commonAttrs(asn, adv))
+	writeAttr(attrs, attrFlagOptional, attrMPReachNLRI, mp.Bytes())
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(0)) // withdrawn routes length (none, IPv6 withdraws use MP_UNREACH_NLRI)
+	binary.Write(body, binary.BigEndian, uint16(attrs.Len()))
+	body.Write(attrs.Bytes())
+
+	return writeMessage(w, msgUpdate, body.Bytes())
+}
+
+// MarshalUpdate encodes adv as a single BGP UPDATE PDU. It's exported
+// for observers (see the bmp subpackage) that need to mirror an update
+// that was already sent, without duplicating the wire format.
+func MarshalUpdate(asn uint32, adv *Advertisement) []byte {
+	buf := &bytes.Buffer{}
+	if familyFor(adv.Prefix.IP) == familyIPv4 {
+		sendUpdateV4(buf, asn, adv)
+	} else {
+		sendUpdateV6(buf, asn, adv)
+	}
+	return buf.Bytes()
+}
+
+// MarshalWithdraw encodes the withdrawal of prefix as a single BGP
+// UPDATE PDU.
+func MarshalWithdraw(prefix *net.IPNet) []byte {
+	buf := &bytes.Buffer{}
+	if familyFor(prefix.IP) == familyIPv4 {
+		sendWithdrawV4(buf, []*net.IPNet{prefix})
+	} else {
+		sendWithdrawV6(buf, []*net.IPNet{prefix})
+	}
+	return buf.Bytes()
+}
+
+func sendWithdrawV4(w io.Writer, routes []*net.IPNet) error {
+	wdr := &bytes.Buffer{}
+	for _, r := range routes {
+		wdr.Write(encodeNLRI(r))
+	}
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(wdr.Len()))
+	body.Write(wdr.Bytes())
+	binary.Write(body, binary.BigEndian, uint16(0)) // total path attribute length
+
+	return writeMessage(w, msgUpdate, body.Bytes())
+}
+
+func sendWithdrawV6(w io.Writer, routes []*net.IPNet) error {
+	mp := &bytes.Buffer{}
+	binary.Write(mp, binary.BigEndian, familyIPv6.afi)
+	mp.WriteByte(familyIPv6.safi)
+	for _, r := range routes {
+		mp.Write(encodeNLRI(r))
+	}
+
+	attrs := &bytes.Buffer{}
+	writeAttr(attrs, attrFlagOptional, attrMPUnreachNLRI, mp.Bytes())
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(0)) // withdrawn routes length
+	binary.Write(body, binary.BigEndian, uint16(attrs.Len()))
+	body.Write(attrs.Bytes())
+
+	return writeMessage(w, msgUpdate, body.Bytes())
+}
@@ -0,0 +1,60 @@
+package bgp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeNLRIv4(t *testing.T) {
+	_, n, err := net.ParseCIDR("10.1.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := encodeNLRI(n)
+	want := []byte{24, 10, 1, 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeNLRI(%s) = %v, want %v", n, got, want)
+	}
+}
+
+func TestEncodeNLRIv4HostRoute(t *testing.T) {
+	_, n, err := net.ParseCIDR("10.1.2.3/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := encodeNLRI(n)
+	want := []byte{32, 10, 1, 2, 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeNLRI(%s) = %v, want %v", n, got, want)
+	}
+}
+
+func TestEncodeNLRIv6(t *testing.T) {
+	_, n, err := net.ParseCIDR("2001:db8:1234::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := encodeNLRI(n)
+	want := []byte{48, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeNLRI(%s) = %v, want %v", n, got, want)
+	}
+}
+
+// TestEncodeNLRIv4FromSixteenByteIP covers an IPNet built with the
+// 16-byte (IPv4-in-IPv6) form of n.IP, e.g. one built from net.ParseIP
+// rather than net.ParseCIDR. encodeNLRI must still read the real address
+// bytes, not the leading bytes of the v4-mapped representation.
+func TestEncodeNLRIv4FromSixteenByteIP(t *testing.T) {
+	n := &net.IPNet{IP: net.ParseIP("10.1.2.0"), Mask: net.CIDRMask(24, 32)}
+
+	got := encodeNLRI(n)
+	want := []byte{24, 10, 1, 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeNLRI(%s) = %v, want %v", n, got, want)
+	}
+}
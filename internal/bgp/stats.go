@@ -0,0 +1,169 @@
+package bgp
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var stats = metrics{
+	sessionUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "up",
+		Help:      "BGP session state (1 = established, 0 = down)",
+	}, []string{"peer"}),
+
+	prefixes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "prefixes",
+		Help:      "Number of prefixes currently advertised to the peer",
+	}, []string{"peer"}),
+
+	pendingPrefixes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "pending_prefixes",
+		Help:      "Number of prefixes queued to be advertised to the peer",
+	}, []string{"peer"}),
+
+	updatesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "update_total",
+		Help:      "Number of BGP UPDATE messages sent",
+	}, []string{"peer"}),
+
+	teardowns: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "teardown_total",
+		Help:      "Number of times the BGP session was torn down, by reason",
+	}, []string{"peer", "reason"}),
+
+	authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "auth_failure_total",
+		Help:      "Number of times establishing an authenticated (TCP-MD5/TCP-AO) connection to the peer failed",
+	}, []string{"peer"}),
+
+	queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "write_queue_depth",
+		Help:      "Number of encoded BGP messages waiting to be written to the peer",
+	}, []string{"peer"}),
+
+	messagesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "write_queue_dropped_total",
+		Help:      "Number of BGP messages dropped because the write queue to the peer was full",
+	}, []string{"peer"}),
+
+	writeLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp_session",
+		Name:      "write_latency_seconds",
+		Help:      "Time taken to write a batch of BGP messages to the peer's socket",
+	}, []string{"peer"}),
+}
+
+func init() {
+	prometheus.MustRegister(stats.sessionUp)
+	prometheus.MustRegister(stats.prefixes)
+	prometheus.MustRegister(stats.pendingPrefixes)
+	prometheus.MustRegister(stats.updatesSent)
+	prometheus.MustRegister(stats.teardowns)
+	prometheus.MustRegister(stats.authFailures)
+	prometheus.MustRegister(stats.queueDepth)
+	prometheus.MustRegister(stats.messagesDropped)
+	prometheus.MustRegister(stats.writeLatency)
+}
+
+type metrics struct {
+	sessionUp       *prometheus.GaugeVec
+	prefixes        *prometheus.GaugeVec
+	pendingPrefixes *prometheus.GaugeVec
+	updatesSent     *prometheus.CounterVec
+	teardowns       *prometheus.CounterVec
+	authFailures    *prometheus.CounterVec
+	queueDepth      *prometheus.GaugeVec
+	messagesDropped *prometheus.CounterVec
+	writeLatency    *prometheus.HistogramVec
+}
+
+func (m *metrics) SessionUp(peer string) {
+	m.sessionUp.WithLabelValues(peer).Set(1)
+}
+
+func (m *metrics) SessionDown(peer string) {
+	m.sessionUp.WithLabelValues(peer).Set(0)
+}
+
+func (m *metrics) DeleteSession(peer string) {
+	m.sessionUp.DeleteLabelValues(peer)
+	m.prefixes.DeleteLabelValues(peer)
+	m.pendingPrefixes.DeleteLabelValues(peer)
+}
+
+func (m *metrics) AdvertisedPrefixes(peer string, n int) {
+	m.prefixes.WithLabelValues(peer).Set(float64(n))
+}
+
+func (m *metrics) PendingPrefixes(peer string, n int) {
+	m.pendingPrefixes.WithLabelValues(peer).Set(float64(n))
+}
+
+func (m *metrics) UpdateSent(peer string) {
+	m.updatesSent.WithLabelValues(peer).Inc()
+}
+
+// TeardownReason records why a session was torn down, e.g. "holdtime" vs
+// "bfd", so operators can tell a slow BGP-level failure detection apart
+// from a fast BFD-triggered one.
+func (m *metrics) TeardownReason(peer, reason string) {
+	m.teardowns.WithLabelValues(peer, reason).Inc()
+}
+
+// AuthFailure records a failed attempt to establish an authenticated
+// connection to peer (bad kernel support, rejected signature, etc).
+func (m *metrics) AuthFailure(peer string) {
+	m.authFailures.WithLabelValues(peer).Inc()
+}
+
+// QueueDepth records the current number of messages waiting in the
+// writer goroutine's queue for peer.
+func (m *metrics) QueueDepth(peer string, depth int) {
+	m.queueDepth.WithLabelValues(peer).Set(float64(depth))
+}
+
+// MessageDropped records that a message to peer was dropped because its
+// write queue was full, rather than blocking the caller.
+func (m *metrics) MessageDropped(peer string) {
+	m.messagesDropped.WithLabelValues(peer).Inc()
+}
+
+// WriteLatency records how long a batch write to peer's socket took.
+func (m *metrics) WriteLatency(peer string, d time.Duration) {
+	m.writeLatency.WithLabelValues(peer).Observe(d.Seconds())
+}
+
+// UpdatesSent returns the number of UPDATE messages sent to peer so far.
+// It's exported for observers (see the bmp subpackage) that periodically
+// report the metrics we already collect, rather than keeping their own
+// duplicate counters.
+func UpdatesSent(peer string) uint64 {
+	return counterValue(stats.updatesSent.WithLabelValues(peer))
+}
+
+func counterValue(c prometheus.Counter) uint64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return uint64(m.GetCounter().GetValue())
+}